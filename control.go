@@ -0,0 +1,357 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// A pipelineHandle tracks the running state of one log's pipeline: the
+// config it was started with, its resolved notifiers, and the means to
+// stop it and wait for it to exit.
+type pipelineHandle struct {
+	logc      logConfig
+	notifiers []Notifier
+	stop      chan struct{}
+	stopped   chan struct{}
+}
+
+// A daemon owns every pipeline in a running zaqar process. The control
+// socket operates entirely through it: status, flush, reload and tail all
+// resolve against its current set of pipelines.
+type daemon struct {
+	mu         sync.Mutex
+	configFile string
+	conf       *Config
+	collector  *collector
+	store      *StateStore
+	notifiers  map[string]Notifier
+	pipelines  map[string]*pipelineHandle
+	wg         sync.WaitGroup
+}
+
+// Build a daemon from a loaded config. No pipelines are started yet; call
+// StartAll for that.
+func NewDaemon(configFile string, conf *Config, store *StateStore) (*daemon, error) {
+	notifiers, err := buildNotifiers(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	return &daemon{
+		configFile: configFile,
+		conf:       conf,
+		collector:  NewCollector(),
+		store:      store,
+		notifiers:  notifiers,
+		pipelines:  make(map[string]*pipelineHandle),
+	}, nil
+}
+
+// Build the notifier registry described by a config's [notifiers.*] table.
+func buildNotifiers(conf *Config) (map[string]Notifier, error) {
+	notifiers := make(map[string]Notifier, len(conf.Notifiers))
+	for name, nc := range conf.Notifiers {
+		n, err := NewNotifier(name, nc)
+		if err != nil {
+			return nil, err
+		}
+		notifiers[name] = n
+	}
+
+	return notifiers, nil
+}
+
+// Start every log in the daemon's current config.
+func (d *daemon) StartAll() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for name, logc := range d.conf.Logs {
+		d.startLocked(name, logc)
+	}
+}
+
+// Start a single log's pipeline. Caller must hold d.mu.
+func (d *daemon) startLocked(name string, logc logConfig) {
+	notifiers, err := d.notifiersFor(name, logc)
+	if err != nil {
+		log.Printf("Error: %s", err.Error())
+		return
+	}
+
+	handle := &pipelineHandle{logc: logc, notifiers: notifiers, stop: make(chan struct{}), stopped: make(chan struct{})}
+	d.pipelines[name] = handle
+	d.wg.Add(1)
+
+	go func() {
+		defer d.wg.Done()
+		defer close(handle.stopped)
+		startPipeline(name, logc, d.collector, notifiers, d.store, handle.stop)
+	}()
+}
+
+// Resolve a log's configured notifier names against the registry.
+func (d *daemon) notifiersFor(name string, logc logConfig) ([]Notifier, error) {
+	notifiers := make([]Notifier, 0, len(logc.Notifiers))
+	for _, n := range logc.Notifiers {
+		notifier, ok := d.notifiers[n]
+		if !ok {
+			return nil, fmt.Errorf("log %q references unknown notifier %q", name, n)
+		}
+		notifiers = append(notifiers, notifier)
+	}
+
+	return notifiers, nil
+}
+
+// Stop a single log's pipeline and wait for it to exit. Caller must hold
+// d.mu; it's released while waiting and re-acquired before returning.
+func (d *daemon) stopLocked(name string) {
+	handle, ok := d.pipelines[name]
+	if !ok {
+		return
+	}
+
+	delete(d.pipelines, name)
+	close(handle.stop)
+
+	d.mu.Unlock()
+	<-handle.stopped
+	d.mu.Lock()
+}
+
+// Wait for every running pipeline goroutine to exit.
+func (d *daemon) Wait() {
+	d.wg.Wait()
+}
+
+// Force an immediate notification of whatever a log has collected so far,
+// regardless of threshold.
+func (d *daemon) Flush(name string) error {
+	d.mu.Lock()
+	handle, ok := d.pipelines[name]
+	d.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("no running log named %q", name)
+	}
+
+	d.collector.Flush(name, handle.notifiers)
+	return nil
+}
+
+// Re-read the config file and diff it against the running pipelines: stop
+// ones that were removed, start ones that are new, and restart ones whose
+// config changed.
+func (d *daemon) Reload() error {
+	conf, err := NewConfig(d.configFile)
+	if err != nil {
+		return err
+	}
+
+	notifiers, err := buildNotifiers(conf)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.conf = conf
+	d.notifiers = notifiers
+
+	for name := range d.pipelines {
+		if _, ok := conf.Logs[name]; !ok {
+			d.stopLocked(name)
+		}
+	}
+
+	for name, logc := range conf.Logs {
+		if existing, ok := d.pipelines[name]; ok {
+			if reflect.DeepEqual(existing.logc, logc) {
+				continue
+			}
+			d.stopLocked(name)
+		}
+
+		d.startLocked(name, logc)
+	}
+
+	return nil
+}
+
+// A snapshot of one log's runtime status, for the control API.
+type logStatus struct {
+	LineCount  int64                `json:"line_count"`
+	MatchCount int                  `json:"match_count"`
+	LastAlert  *time.Time           `json:"last_alert,omitempty"`
+	Cooldowns  map[string]time.Time `json:"cooldowns,omitempty"`
+}
+
+// Report every running log's line count, match count, last alert time and
+// any active cooldowns.
+func (d *daemon) Status() map[string]logStatus {
+	d.mu.Lock()
+	names := make([]string, 0, len(d.pipelines))
+	for name := range d.pipelines {
+		names = append(names, name)
+	}
+	d.mu.Unlock()
+
+	status := make(map[string]logStatus, len(names))
+	for _, name := range names {
+		st := logStatus{
+			LineCount:  d.collector.LineCount(name),
+			MatchCount: len(d.collector.Errors(name)),
+			Cooldowns:  d.collector.throttler.Cooldowns(name),
+		}
+		if t, ok := d.collector.LastAlert(name); ok {
+			st.LastAlert = &t
+		}
+		status[name] = st
+	}
+
+	return status
+}
+
+// A control API request, as sent by zaqar-cli.
+type controlRequest struct {
+	Command string `json:"command"`
+	LogName string `json:"log_name,omitempty"`
+}
+
+// A control API response, for every command except `tail` (which streams
+// raw lines instead).
+type controlResponse struct {
+	Result string `json:"result,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Listen on socketPath and serve control API connections against d until
+// the process exits.
+func serveControlSocket(socketPath string, d *daemon) {
+	os.Remove(socketPath) // clear a stale socket left by a previous run
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("Control socket listening on %s", socketPath)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Printf("Error: control socket accept: %s", err.Error())
+			continue
+		}
+
+		go handleControlConn(conn, d)
+	}
+}
+
+// Handle a single control API connection: one request, one response (or,
+// for `tail`, a stream of lines until the client disconnects).
+func handleControlConn(conn net.Conn, d *daemon) {
+	defer conn.Close()
+
+	var req controlRequest
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		json.NewEncoder(conn).Encode(controlResponse{Error: err.Error()})
+		return
+	}
+
+	switch req.Command {
+	case "status":
+		status, err := json.MarshalIndent(d.Status(), "", "  ")
+		if err != nil {
+			json.NewEncoder(conn).Encode(controlResponse{Error: err.Error()})
+			return
+		}
+		json.NewEncoder(conn).Encode(controlResponse{Result: string(status)})
+
+	case "flush":
+		if err := d.Flush(req.LogName); err != nil {
+			json.NewEncoder(conn).Encode(controlResponse{Error: err.Error()})
+			return
+		}
+		json.NewEncoder(conn).Encode(controlResponse{Result: fmt.Sprintf("flushed %s", req.LogName)})
+
+	case "reload":
+		if err := d.Reload(); err != nil {
+			json.NewEncoder(conn).Encode(controlResponse{Error: err.Error()})
+			return
+		}
+		json.NewEncoder(conn).Encode(controlResponse{Result: "reloaded"})
+
+	case "tail":
+		ch, cancel := d.collector.Subscribe(req.LogName)
+		defer cancel()
+
+		for line := range ch {
+			if _, err := fmt.Fprintln(conn, line); err != nil {
+				return
+			}
+		}
+
+	default:
+		json.NewEncoder(conn).Encode(controlResponse{Error: fmt.Sprintf("unknown command %q", req.Command)})
+	}
+}
+
+// runCLI is zaqar-cli: it dials a running daemon's control socket, sends
+// one request, and prints the result.
+func runCLI(args []string) {
+	fs := flag.NewFlagSet("zaqar cli", flag.ExitOnError)
+	socketPath := fs.String("socket", "/var/run/zaqar.sock", "path to the zaqar control socket")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s cli [-socket path] <status|flush|reload|tail> [logname]\n", NAME)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	rest := fs.Args()
+	if len(rest) < 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	req := controlRequest{Command: rest[0]}
+	if len(rest) > 1 {
+		req.LogName = rest[1]
+	}
+
+	conn, err := net.Dial("unix", *socketPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		log.Fatal(err)
+	}
+
+	if req.Command == "tail" {
+		io.Copy(os.Stdout, conn)
+		return
+	}
+
+	var resp controlResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		log.Fatal(err)
+	}
+
+	if resp.Error != "" {
+		fmt.Fprintln(os.Stderr, "Error:", resp.Error)
+		os.Exit(1)
+	}
+
+	fmt.Println(resp.Result)
+}
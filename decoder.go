@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+// An Event is a single decoded log record. Every Event carries the
+// original text under lineField; structured decoders add further fields
+// on top of that.
+type Event map[string]interface{}
+
+// The event field that always holds the original, undecoded line.
+const lineField = "line"
+
+// A Decoder turns one raw log line into an Event.
+type Decoder interface {
+	Decode(line string) (Event, error)
+}
+
+// Build the Decoder for a log's configured format. An empty format means
+// "raw": one event per line, untouched.
+func NewDecoder(format string) (Decoder, error) {
+	switch format {
+	case "", "raw":
+		return rawDecoder{}, nil
+	case "json":
+		return jsonDecoder{}, nil
+	case "logfmt":
+		return logfmtDecoder{}, nil
+	case "syslog-rfc5424":
+		return syslogDecoder{}, nil
+	case "msgpack":
+		return msgpackDecoder{}, nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+}
+
+// rawDecoder passes the line through unparsed.
+type rawDecoder struct{}
+
+// Decode wraps the line with no further parsing.
+func (rawDecoder) Decode(line string) (Event, error) {
+	return Event{lineField: line}, nil
+}
+
+// jsonDecoder parses each line as a standalone JSON object.
+type jsonDecoder struct{}
+
+// Decode unmarshals the line as JSON.
+func (jsonDecoder) Decode(line string) (Event, error) {
+	event := Event{}
+	if err := json.Unmarshal([]byte(line), &event); err != nil {
+		return nil, err
+	}
+
+	event[lineField] = line
+	return event, nil
+}
+
+// msgpackDecoder parses each line as a base64-encoded msgpack map. The
+// pipeline reads logs through the same newline-oriented scanner as every
+// other format, but a raw msgpack record routinely contains 0x0a bytes
+// that aren't real record boundaries; base64-encoding one record per line
+// keeps it safe to split on newlines like the rest.
+type msgpackDecoder struct{}
+
+// Decode base64-decodes the line, then unmarshals the result as msgpack.
+func (msgpackDecoder) Decode(line string) (Event, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(line))
+	if err != nil {
+		return nil, fmt.Errorf("msgpack: line is not valid base64: %w", err)
+	}
+
+	event := Event{}
+	if err := msgpack.Unmarshal(raw, &event); err != nil {
+		return nil, err
+	}
+
+	event[lineField] = line
+	return event, nil
+}
+
+// logfmtDecoder parses Heroku/go-kit style "key=value" pairs.
+type logfmtDecoder struct{}
+
+// Decode splits the line into key=value fields.
+func (logfmtDecoder) Decode(line string) (Event, error) {
+	event := Event{}
+	for _, kv := range splitLogfmt(line) {
+		event[kv[0]] = kv[1]
+	}
+
+	event[lineField] = line
+	return event, nil
+}
+
+// Split a logfmt line into (key, value) pairs, trimming any quoting
+// around the value.
+func splitLogfmt(line string) []StringTuple {
+	var pairs []StringTuple
+
+	for _, field := range tokenizeLogfmt(line) {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		pairs = append(pairs, StringTuple{kv[0], strings.Trim(kv[1], `"`)})
+	}
+
+	return pairs
+}
+
+// Split a logfmt line into key=value tokens on whitespace, the way
+// strings.Fields does, except whitespace inside a double-quoted value
+// (e.g. msg="hello world") doesn't count as a separator.
+func tokenizeLogfmt(line string) []string {
+	var fields []string
+	var field strings.Builder
+	inQuotes := false
+
+	flush := func() {
+		if field.Len() > 0 {
+			fields = append(fields, field.String())
+			field.Reset()
+		}
+	}
+
+	for _, r := range line {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+			field.WriteRune(r)
+		case unicode.IsSpace(r) && !inQuotes:
+			flush()
+		default:
+			field.WriteRune(r)
+		}
+	}
+	flush()
+
+	return fields
+}
+
+// Match an RFC5424 syslog header: <PRI>VERSION TIMESTAMP HOSTNAME APP-NAME
+// PROCID MSGID MSG. Structured data is left out of scope.
+var syslogRE = regexp.MustCompile(`^<(\d+)>(\d+) (\S+) (\S+) (\S+) (\S+) (\S+) (.*)$`)
+
+// syslogDecoder parses RFC5424-framed syslog lines.
+type syslogDecoder struct{}
+
+// Decode splits the RFC5424 header out into fields.
+func (syslogDecoder) Decode(line string) (Event, error) {
+	m := syslogRE.FindStringSubmatch(line)
+	if m == nil {
+		return nil, fmt.Errorf("line does not match RFC5424 syslog format")
+	}
+
+	pri, err := strconv.Atoi(m[1])
+	if err != nil {
+		return nil, err
+	}
+
+	return Event{
+		lineField:   line,
+		"facility":  pri / 8,
+		"severity":  pri % 8,
+		"version":   m[2],
+		"timestamp": m[3],
+		"hostname":  m[4],
+		"app_name":  m[5],
+		"proc_id":   m[6],
+		"msg_id":    m[7],
+		"msg":       m[8],
+	}, nil
+}
+
+// A field-aware matcher. Criteria is "<field> <op> [value]", e.g.
+// "severity gte 4" or "msg regexp panic".
+type fieldMatcher struct {
+	field string
+	op    string
+	value string
+	re    *regexp.Regexp // only set when op == "regexp"
+}
+
+// Create a new field matcher, parsing its criteria string.
+func NewFieldMatcher(criteria string) (*fieldMatcher, error) {
+	parts := strings.SplitN(criteria, " ", 3)
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("field matcher criteria %q must be \"<field> <op> [value]\"", criteria)
+	}
+
+	fm := &fieldMatcher{field: parts[0], op: parts[1]}
+	if len(parts) == 3 {
+		fm.value = parts[2]
+	}
+
+	if fm.op == "regexp" {
+		fm.re = regexp.MustCompile(fm.value)
+	}
+
+	return fm, nil
+}
+
+// Apply the matcher.
+func (m *fieldMatcher) Match(event Event) bool {
+	value, ok := event[m.field]
+	if m.op == "exists" {
+		return ok
+	}
+	if !ok {
+		return false
+	}
+
+	switch m.op {
+	case "eq":
+		return fmt.Sprint(value) == m.value
+	case "contains":
+		return strings.Contains(fmt.Sprint(value), m.value)
+	case "regexp":
+		return m.re.MatchString(fmt.Sprint(value))
+	case "gte", "lte":
+		fv, err := toFloat(value)
+		if err != nil {
+			return false
+		}
+
+		cv, err := strconv.ParseFloat(m.value, 64)
+		if err != nil {
+			return false
+		}
+
+		if m.op == "gte" {
+			return fv >= cv
+		}
+		return fv <= cv
+	default:
+		return false
+	}
+}
+
+// Coerce a decoded field value to a float64 for numeric comparisons.
+func toFloat(v interface{}) (float64, error) {
+	switch t := v.(type) {
+	case float64:
+		return t, nil
+	case int:
+		return float64(t), nil
+	case string:
+		return strconv.ParseFloat(t, 64)
+	default:
+		return 0, fmt.Errorf("cannot convert %T to float", v)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import "testing"
+
+func TestSplitLogfmtQuotedValues(t *testing.T) {
+	line := `level=info msg="hello world" count=3`
+	pairs := splitLogfmt(line)
+
+	got := map[string]string{}
+	for _, kv := range pairs {
+		got[kv[0]] = kv[1]
+	}
+
+	want := map[string]string{"level": "info", "msg": "hello world", "count": "3"}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("splitLogfmt(%q)[%q] = %q, want %q", line, k, got[k], v)
+		}
+	}
+}
+
+func TestFieldMatcherMatch(t *testing.T) {
+	event := Event{"severity": 5.0, "msg": "disk panic on sda1"}
+
+	tests := []struct {
+		criteria string
+		want     bool
+	}{
+		{"severity eq 5", true},
+		{"severity eq 4", false},
+		{"severity gte 4", true},
+		{"severity lte 4", false},
+		{"msg contains panic", true},
+		{"msg contains oops", false},
+		{"msg regexp ^disk", true},
+		{"msg regexp ^nope", false},
+		{"missing exists", false},
+		{"severity exists", true},
+	}
+
+	for _, tt := range tests {
+		m, err := NewFieldMatcher(tt.criteria)
+		if err != nil {
+			t.Fatalf("NewFieldMatcher(%q): %s", tt.criteria, err)
+		}
+
+		if got := m.Match(event); got != tt.want {
+			t.Errorf("Match(%q) = %v, want %v", tt.criteria, got, tt.want)
+		}
+	}
+}
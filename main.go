@@ -4,47 +4,70 @@ import (
 	"bufio"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"regexp"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/BurntSushi/toml"
-	"github.com/mailgun/mailgun-go"
 )
 
 const (
 	NAME    = "zaqar"
 	VERSION = "0.0.1"
 	CONFIG  = "/etc/zaqar/config.toml"
+
+	// Default interval between rotation checks when a log doesn't set its own.
+	defaultRotationCheck = 2 * time.Second
 )
 
 var (
-	configFile string
-	debug      bool
+	configFile     string
+	debug          bool
+	resetState     string
+	printStateFlag bool
+	socket         string
 )
 
-// A Mailgun config set.
-type mailgunConfig struct {
-	Domain       string `toml:"domain"`
-	ApiKey       string `toml:"apikey"`
-	PublicApiKey string `toml:"publicapikey"`
-}
-
 // A two-element string tuple.
 type StringTuple [2]string
 
+// A TOML-friendly time.Duration, parsed from strings like "30s" or "5m".
+type duration time.Duration
+
+// Unmarshal a TOML string into a duration.
+func (d *duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+
+	*d = duration(parsed)
+	return nil
+}
+
 // A log config set.
 type logConfig struct {
-	Path     string        `toml:"path"`
-	Matchers []StringTuple `toml:'matchers'`
+	Path          string        `toml:"path"`
+	Matchers      []StringTuple `toml:'matchers'`
+	Follow        bool          `toml:"follow"`
+	RotationCheck duration      `toml:"rotation_check"`
+	Notifiers     []string      `toml:"notifiers"`
+	Format        string        `toml:"format"`
+	Window        duration      `toml:"window"`
+	Threshold     int           `toml:"threshold"`
+	Cooldown      duration      `toml:"cooldown"`
+	GroupBy       []string      `toml:"group_by"`
 }
 
 // A configuration set.
 type Config struct {
-	Mailgun mailgunConfig `toml:"mailgun"`
-	Logs    map[string]logConfig
+	Notifiers map[string]notifierConfig `toml:"notifiers"`
+	Logs      map[string]logConfig
+	StateDir  string `toml:"state_dir"`
 }
 
 // Create a new Config.
@@ -62,30 +85,102 @@ func NewConfig(file string) (*Config, error) {
 	return &c, nil
 }
 
-// An output collector.
+// An output collector. It keeps every match seen (for introspection) and
+// runs each one through a throttler that decides when a notification is
+// actually due.
 type collector struct {
-	domain       string
-	apiKey       string
-	publicApiKey string
-	errors       map[string][]string
-	mu           sync.RWMutex
+	errors    map[string][]Match
+	lines     map[string]int64
+	lastAlert map[string]time.Time
+	throttler *throttler
+	subs      map[string][]chan string
+	mu        sync.RWMutex
 }
 
 // Create a new collector.
-func NewCollector(domain, apiKey, publicApiKey string) *collector {
-	return &collector{domain: domain, apiKey: apiKey, publicApiKey: publicApiKey, errors: make(map[string][]string)}
+func NewCollector() *collector {
+	return &collector{
+		errors:    make(map[string][]Match),
+		lines:     make(map[string]int64),
+		lastAlert: make(map[string]time.Time),
+		throttler: NewThrottler(),
+		subs:      make(map[string][]chan string),
+	}
+}
+
+// Count one more line read from a log, regardless of whether it matched.
+func (c *collector) CountLine(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lines[name]++
+}
+
+// Return the number of lines read so far for a log.
+func (c *collector) LineCount(name string) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lines[name]
 }
 
-// Add an error for a specific log to the collector.
-func (c *collector) Add(name, message string) {
+// Return the time of a log's last notification, if it has had one.
+func (c *collector) LastAlert(name string) (time.Time, bool) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	t, ok := c.lastAlert[name]
+	return t, ok
+}
+
+// Add a match for a specific log, notifying if the throttler decides this
+// one tips its group over threshold. captures holds the matching regexp's
+// capture groups, if any, for group_by entries that reference them by
+// index instead of a field name.
+func (c *collector) Add(name string, logc logConfig, event Event, notifiers []Notifier, captures []string) {
+	line := lineOf(event)
+
+	c.mu.Lock()
 	if _, ok := c.errors[name]; !ok {
-		c.errors[name] = []string{}
+		c.errors[name] = []Match{}
+	}
+	c.errors[name] = append(c.errors[name], Match{Line: line})
+	for _, sub := range c.subs[name] {
+		select {
+		case sub <- line:
+		default: // a slow tail subscriber shouldn't stall the pipeline
+		}
 	}
+	c.mu.Unlock()
 
-	c.errors[name] = append(c.errors[name], message)
+	if summary, ready := c.throttler.Record(name, logc, event, captures); ready {
+		c.notify(name, summary, notifiers)
+	}
+}
+
+// Subscribe to a log's matched lines as they're added, for `tail`. Returns
+// the channel to read from and a function to unsubscribe and release it.
+func (c *collector) Subscribe(name string) (chan string, func()) {
+	c.mu.Lock()
+	ch := make(chan string, 16)
+	c.subs[name] = append(c.subs[name], ch)
+	c.mu.Unlock()
+
+	cancel := func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		subs := c.subs[name]
+		for i, sub := range subs {
+			if sub == ch {
+				c.subs[name] = append(subs[:i], subs[i+1:]...)
+				break
+			}
+		}
+		close(ch)
+	}
+
+	return ch, cancel
 }
 
 // Check if a specific log has any errors listed.
@@ -99,37 +194,43 @@ func (c *collector) HasErrors(name string) bool {
 }
 
 // Return all errors for a specifig log.
-func (c *collector) Errors(name string) []string {
+func (c *collector) Errors(name string) []Match {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	return c.errors[name]
 }
 
-// Send an email report for errors in this log.
-func (c *collector) Send(name string) {
-	if c.HasErrors(name) {
-		mg := mailgun.NewMailgun(c.domain, c.apiKey, c.publicApiKey)
-		m := mg.NewMessage(
-			"Melon Developers <devs@melon.com.au>", // From
-			fmt.Sprintf("Log Errors: %s", name),    // Subject
-			strings.Join(c.errors[name], "\n"),     // Plain-text body
-			"Melon Developers <devs@melon.com.au>", // Recipients (vararg list)
-		)
-
-		if _, _, err := mg.Send(m); err != nil {
-			log.Printf("Error: could not send log error report for %s: %s", name, err.Error())
+// Flush any matches still pending below threshold for a log, notifying
+// for them regardless. Used at EOF for one-shot runs, which don't get a
+// later chance to cross threshold.
+func (c *collector) Flush(name string, notifiers []Notifier) {
+	for _, summary := range c.throttler.Flush(name) {
+		c.notify(name, summary, notifiers)
+	}
+}
+
+// Hand a summary to every notifier, logging (but not failing on) errors.
+func (c *collector) notify(name string, summary Summary, notifiers []Notifier) {
+	c.mu.Lock()
+	c.lastAlert[name] = time.Now()
+	c.mu.Unlock()
+
+	for _, n := range notifiers {
+		if err := n.Notify(name, summary); err != nil {
+			log.Printf("Error: could not notify for %s: %s", name, err.Error())
 		}
-		log.Printf("Sending: %s", strings.Join(c.errors[name], "\n"))
 	}
+	log.Printf("Sending: %s", joinLines(summary.Samples))
 }
 
-// A matcher interface.
+// A matcher interface. Matchers evaluate a decoded Event rather than a
+// raw line, so whole-line and field-aware matchers can be mixed freely.
 type matcher interface {
-	Match(string) bool
+	Match(Event) bool
 }
 
-// A regexp matcher.
+// A regexp matcher, applied against the event's raw line.
 type regexpMatcher struct {
 	criteria string
 	re       *regexp.Regexp
@@ -141,8 +242,8 @@ func NewRegexpMatcher(criteria string) *regexpMatcher {
 }
 
 // Apply the matcher.
-func (m *regexpMatcher) Match(text string) bool {
-	match := m.re.FindStringIndex(text)
+func (m *regexpMatcher) Match(event Event) bool {
+	match := m.re.FindStringIndex(lineOf(event))
 
 	if match == nil || len(match) < 1 {
 		return false
@@ -150,7 +251,13 @@ func (m *regexpMatcher) Match(text string) bool {
 	return true
 }
 
-// A substring matcher.
+// Return this matcher's capture groups for a line, index 0 being the whole
+// match, so group_by can reference them by index.
+func (m *regexpMatcher) Captures(line string) []string {
+	return m.re.FindStringSubmatch(line)
+}
+
+// A substring matcher, applied against the event's raw line.
 type substringMatcher struct {
 	criteria string
 }
@@ -161,8 +268,14 @@ func NewSubstringMatcher(criteria string) *substringMatcher {
 }
 
 // Apply the matcher.
-func (m *substringMatcher) Match(text string) bool {
-	return strings.Contains(m.criteria, text)
+func (m *substringMatcher) Match(event Event) bool {
+	return strings.Contains(lineOf(event), m.criteria)
+}
+
+// Return the raw line an event was decoded from.
+func lineOf(event Event) string {
+	line, _ := event[lineField].(string)
+	return line
 }
 
 // Package-level init.
@@ -170,6 +283,9 @@ func init() {
 	// Setup cli flags.
 	flag.StringVar(&configFile, "c", "/etc/zaqar/config.toml", "path to the config file")
 	flag.BoolVar(&debug, "debug", false, "turn on debugging")
+	flag.StringVar(&resetState, "reset-state", "", "reset persisted offset state for the named log and exit")
+	flag.BoolVar(&printStateFlag, "print-state", false, "print persisted offset state for every log and exit")
+	flag.StringVar(&socket, "socket", "", "path to a unix socket to serve the control API on")
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "%s v%s\nUsage: %s [arguments] \n", NAME, VERSION, NAME)
 		flag.PrintDefaults()
@@ -181,6 +297,13 @@ func main() {
 	// Clear all log flags.
 	log.SetFlags(0)
 
+	// `zaqar cli ...` is zaqar-cli: it dials a running daemon's control
+	// socket instead of starting pipelines of its own.
+	if len(os.Args) > 1 && os.Args[1] == "cli" {
+		runCLI(os.Args[2:])
+		return
+	}
+
 	// Parse CLI flags.
 	flag.Parse()
 
@@ -190,71 +313,237 @@ func main() {
 		log.Fatal(err)
 	}
 
-	// Create and output collector.
-	collector := NewCollector(conf.Mailgun.Domain, conf.Mailgun.ApiKey, conf.Mailgun.PublicApiKey)
+	stateDir := conf.StateDir
+	if stateDir == "" {
+		stateDir = defaultStateDir
+	}
 
-	// Start a processing pipeline for each log.
-	done := make(chan struct{}, len(conf.Logs))
-	for name, log := range conf.Logs {
-		go startPipeline(name, log, collector, done)
+	store, err := NewStateStore(stateDir)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	// Wait for all pipelines to compelte.
-	for i := 0; i < len(conf.Logs); i++ {
-		<-done
+	// --print-state and --reset-state are one-shot CLI subcommands; they
+	// don't start any pipelines.
+	if printStateFlag {
+		printState(store)
+		return
 	}
+	if resetState != "" {
+		if err := store.Reset(resetState); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Reset state for %s", resetState)
+		return
+	}
+
+	d, err := NewDaemon(configFile, conf, store)
+	if err != nil {
+		log.Fatal(err)
+	}
+	d.StartAll()
+
+	if socket != "" {
+		go serveControlSocket(socket, d)
+	}
+
+	// Wait for every pipeline to complete. Follow-mode logs only do so
+	// when the control socket's `reload` stops them.
+	d.Wait()
 }
 
-// Start a processing pipeline for a log.
-func startPipeline(name string, logc logConfig, collector *collector, done chan struct{}) {
+// Open a log file and stat it, for tailing and later rotation comparisons.
+func openLog(path string) (*os.File, os.FileInfo, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	return file, info, nil
+}
+
+// Start a processing pipeline for a log. Closing stop asks a follow-mode
+// pipeline to exit at its next rotation check; startPipeline returns once
+// it has fully wound down. A per-log failure (bad format, a read error, a
+// reopen that fails) stops only this pipeline: it must never take down a
+// long-running daemon's other logs, so it logs and returns instead of
+// calling log.Fatal.
+func startPipeline(name string, logc logConfig, collector *collector, notifiers []Notifier, store *StateStore, stop <-chan struct{}) {
 	// log.Printf("Starting Pipeline: name: %s  logc: %#v  collector: %#v ", name, logc, collector)
 
 	// Start a worker for each of the configured matchers.
 	wg := &sync.WaitGroup{}
-	queues := make(map[int]chan string)
+	queues := make(map[int]chan Event)
 	for i, m := range logc.Matchers {
-		queues[i] = make(chan string, 1)
+		queues[i] = make(chan Event, 1)
 		wg.Add(1)
-		go startMatcher(name, m[0], m[1], collector, queues[i], wg)
+		go startMatcher(name, m[0], m[1], logc, collector, notifiers, queues[i], wg)
+	}
+	stopMatchers := func() {
+		for _, q := range queues {
+			close(q)
+		}
+		wg.Wait()
 	}
 
-	// Read the log file line by line.
-	file, err := os.Open(logc.Path)
+	// Build the decoder for this log's configured format.
+	decoder, err := NewDecoder(logc.Format)
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("Error: could not start pipeline for %s: %s", name, err.Error())
+		stopMatchers()
+		return
 	}
-	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		// log.Printf("Log Line: %s", scanner.Text())
+	// Read the log file line by line, resuming from its stored offset if
+	// the file hasn't been rotated since.
+	file, info, err := openLog(logc.Path)
+	if err != nil {
+		log.Printf("Error: could not start pipeline for %s: %s", name, err.Error())
+		stopMatchers()
+		return
+	}
+	defer file.Close()
 
-		// Pass each line to each matcher.
-		for _, q := range queues {
-			q <- scanner.Text()
+	dev, ino := fileIdentity(info)
+	var offset int64
+	if st, ok := store.Get(name); ok && st.Dev == dev && st.Ino == ino {
+		if offset, err = file.Seek(st.Offset, io.SeekStart); err != nil {
+			log.Printf("Error: could not resume %s: %s", name, err.Error())
+			stopMatchers()
+			return
 		}
 	}
-	if err := scanner.Err(); err != nil {
-		log.Fatal(err)
+
+	rotationCheck := time.Duration(logc.RotationCheck)
+	if rotationCheck <= 0 {
+		rotationCheck = defaultRotationCheck
 	}
 
-	// Close all matcher input channels.
-	for _, q := range queues {
-		close(q)
+	lastFlush := time.Now()
+	linesSinceFlush := 0
+	flushState := func() {
+		if err := store.Set(name, logState{Offset: offset, Dev: dev, Ino: ino}); err != nil {
+			log.Printf("Error: could not persist state for %s: %s", name, err.Error())
+		}
+		lastFlush = time.Now()
+		linesSinceFlush = 0
 	}
 
-	// Wait for all matchers to finish.
-	wg.Wait()
+	// A bufio.Reader, not a Scanner: ReadString reports whether a token
+	// was actually newline-terminated, so a trailing partial line caught
+	// mid-write is left for the next read instead of being counted and
+	// silently dropped.
+	reader := bufio.NewReader(file)
+	failed := false
+pipelineLoop:
+	for {
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				if err != io.EOF {
+					log.Printf("Error: could not read %s: %s", name, err.Error())
+					failed = true
+					break pipelineLoop
+				}
+				if logc.Follow || line == "" {
+					// A non-newline-terminated tail: leave it unconsumed: the
+					// next read pass (after a reseek to offset) will pick it
+					// up whole once the write completes.
+					break
+				}
+				// A one-shot run gets no later read pass, so its final
+				// unterminated line is processed as it stands.
+			}
+
+			offset += int64(len(line))
+			line = strings.TrimSuffix(line, "\n")
+			collector.CountLine(name)
+
+			event, err := decoder.Decode(line)
+			if err != nil {
+				log.Printf("Error: could not decode line from %s: %s", name, err.Error())
+				continue
+			}
+
+			// Pass the decoded event to each matcher.
+			for _, q := range queues {
+				q <- event
+			}
+
+			linesSinceFlush++
+			if linesSinceFlush >= stateFlushLines || time.Since(lastFlush) >= stateFlushInterval {
+				flushState()
+			}
+		}
 
-	// Send an email report for this log if there were errors.
-	collector.Send(name)
+		// One-shot logs stop at EOF, as before.
+		if !logc.Follow {
+			break
+		}
+
+		select {
+		case <-stop:
+			break pipelineLoop
+		case <-time.After(rotationCheck):
+		}
+
+		newInfo, err := os.Stat(logc.Path)
+		if err != nil {
+			// The path may be mid-rotation; check again next tick.
+			continue
+		}
+
+		if !os.SameFile(info, newInfo) || newInfo.Size() < info.Size() {
+			// logrotate/copytruncate happened: reopen from offset 0. The
+			// matcher goroutines and their queues are untouched.
+			file.Close()
+			if file, info, err = openLog(logc.Path); err != nil {
+				log.Printf("Error: could not reopen %s after rotation: %s", name, err.Error())
+				failed = true
+				break pipelineLoop
+			}
+			dev, ino = fileIdentity(info)
+			offset = 0
+			reader = bufio.NewReader(file)
+			flushState()
+			continue
+		}
 
-	// Signal main that we're done.
-	done <- struct{}{}
+		info = newInfo
+
+		// Rebuild the reader at the current offset every tick, whether or
+		// not a rotation happened: bufio.Reader (like Scanner) treats EOF
+		// as terminal, and reseeking here also discards any read-ahead
+		// buffered past offset for an unterminated trailing line.
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			log.Printf("Error: could not seek %s: %s", name, err.Error())
+			failed = true
+			break pipelineLoop
+		}
+		reader = bufio.NewReader(file)
+	}
+
+	// Close all matcher input channels and wait for them to finish.
+	stopMatchers()
+
+	if failed {
+		return
+	}
+
+	// Persist the final offset and flush any matches that never reached
+	// threshold; a one-shot run gets no later chance to do either.
+	flushState()
+	collector.Flush(name, notifiers)
 }
 
 // Start a matcher.
-func startMatcher(name, flavour, criteria string, collector *collector, queue chan string, wg *sync.WaitGroup) {
+func startMatcher(name, flavour, criteria string, logc logConfig, collector *collector, notifiers []Notifier, queue chan Event, wg *sync.WaitGroup) {
 	defer wg.Done()
 
 	var m matcher
@@ -263,15 +552,31 @@ func startMatcher(name, flavour, criteria string, collector *collector, queue ch
 		m = NewRegexpMatcher(criteria)
 	case "substring":
 		m = NewSubstringMatcher(criteria)
+	case "field":
+		fm, err := NewFieldMatcher(criteria)
+		if err != nil {
+			log.Printf("Error: invalid field matcher %q: %s", criteria, err.Error())
+			return
+		}
+		m = fm
 	default:
 		log.Printf("Error: unknown matcher %s", flavour)
 		return
 	}
 
-	for line := range queue {
-		// Process this line.
-		if m.Match(line) {
-			collector.Add(name, line)
+	for event := range queue {
+		// Process this event.
+		if !m.Match(event) {
+			continue
 		}
+
+		// A regexp matcher's capture groups are available to group_by by
+		// index, on top of the event's own fields.
+		var captures []string
+		if rm, ok := m.(*regexpMatcher); ok {
+			captures = rm.Captures(lineOf(event))
+		}
+
+		collector.Add(name, logc, event, notifiers, captures)
 	}
 }
@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestSubstringMatcherMatch(t *testing.T) {
+	m := NewSubstringMatcher("panic")
+
+	tests := []struct {
+		line string
+		want bool
+	}{
+		{"panic: disk full", true},
+		{"everything is fine", false},
+	}
+
+	for _, tt := range tests {
+		event := Event{lineField: tt.line}
+		if got := m.Match(event); got != tt.want {
+			t.Errorf("Match(%q) = %v, want %v", tt.line, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/mailgun/mailgun-go"
+)
+
+// A Match is a single line that satisfied a matcher, destined for a Notifier.
+type Match struct {
+	Line string
+}
+
+// A Notifier delivers a Summary of the matches collected for a log to some
+// external sink.
+type Notifier interface {
+	Notify(logName string, summary Summary) error
+}
+
+// Config for a single [notifiers.*] table entry. Type selects which
+// Notifier implementation NewNotifier builds; the remaining fields are
+// only meaningful for their matching type.
+type notifierConfig struct {
+	Type string `toml:"type"`
+
+	// mailgun
+	Domain       string `toml:"domain"`
+	ApiKey       string `toml:"apikey"`
+	PublicApiKey string `toml:"publicapikey"`
+
+	// slack, http, splunk
+	URL     string            `toml:"url"`
+	Headers map[string]string `toml:"headers"`
+	Token   string            `toml:"token"` // splunk HEC token
+
+	// exec
+	Command string   `toml:"command"`
+	Args    []string `toml:"args"`
+}
+
+// Build the Notifier described by a notifierConfig.
+func NewNotifier(name string, nc notifierConfig) (Notifier, error) {
+	switch nc.Type {
+	case "mailgun":
+		return NewMailgunNotifier(nc.Domain, nc.ApiKey, nc.PublicApiKey), nil
+	case "slack":
+		return NewSlackNotifier(nc.URL), nil
+	case "http":
+		return NewHTTPNotifier(nc.URL, nc.Headers), nil
+	case "splunk":
+		return NewSplunkNotifier(nc.URL, nc.Token), nil
+	case "exec":
+		return NewExecNotifier(nc.Command, nc.Args), nil
+	default:
+		return nil, fmt.Errorf("unknown notifier type %q for %q", nc.Type, name)
+	}
+}
+
+// Render matches as a single newline-joined block of text.
+func joinLines(matches []Match) string {
+	lines := make([]string, len(matches))
+	for i, m := range matches {
+		lines[i] = m.Line
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// A Mailgun notifier. This is the original notification path.
+type mailgunNotifier struct {
+	domain       string
+	apiKey       string
+	publicApiKey string
+}
+
+// Create a new Mailgun notifier.
+func NewMailgunNotifier(domain, apiKey, publicApiKey string) *mailgunNotifier {
+	return &mailgunNotifier{domain: domain, apiKey: apiKey, publicApiKey: publicApiKey}
+}
+
+// Send an email report for the given summary.
+func (n *mailgunNotifier) Notify(logName string, summary Summary) error {
+	mg := mailgun.NewMailgun(n.domain, n.apiKey, n.publicApiKey)
+	m := mg.NewMessage(
+		"Melon Developers <devs@melon.com.au>",                            // From
+		fmt.Sprintf("Log Errors: %s (%d matches)", logName, summary.Count), // Subject
+		joinLines(summary.Samples),                                         // Plain-text body
+		"Melon Developers <devs@melon.com.au>",                             // Recipients (vararg list)
+	)
+
+	_, _, err := mg.Send(m)
+	return err
+}
+
+// A Slack incoming-webhook notifier.
+type slackNotifier struct {
+	webhookURL string
+}
+
+// Create a new Slack notifier.
+func NewSlackNotifier(webhookURL string) *slackNotifier {
+	return &slackNotifier{webhookURL: webhookURL}
+}
+
+// Post a summary of the matches to the configured webhook.
+func (n *slackNotifier) Notify(logName string, summary Summary) error {
+	payload, err := json.Marshal(map[string]string{
+		"text": fmt.Sprintf("*%s*: %d matches between %s and %s\n```%s```",
+			logName, summary.Count, summary.First.Format(time.RFC3339), summary.Last.Format(time.RFC3339), joinLines(summary.Samples)),
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.Post(n.webhookURL, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("slack: unexpected status %s", resp.Status)
+	}
+
+	return nil
+}
+
+// A generic HTTP webhook notifier: POSTs a JSON body with configurable
+// headers.
+type httpNotifier struct {
+	url     string
+	headers map[string]string
+}
+
+// Create a new HTTP notifier.
+func NewHTTPNotifier(url string, headers map[string]string) *httpNotifier {
+	return &httpNotifier{url: url, headers: headers}
+}
+
+// POST the summary as JSON to the configured URL.
+func (n *httpNotifier) Notify(logName string, summary Summary) error {
+	body, err := json.Marshal(struct {
+		Log     string  `json:"log"`
+		Summary Summary `json:"summary"`
+	}{Log: logName, Summary: summary})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range n.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("http: unexpected status %s", resp.Status)
+	}
+
+	return nil
+}
+
+// A Splunk HTTP Event Collector notifier.
+type splunkNotifier struct {
+	url   string
+	token string
+}
+
+// Create a new Splunk HEC notifier.
+func NewSplunkNotifier(url, token string) *splunkNotifier {
+	return &splunkNotifier{url: url, token: token}
+}
+
+// POST the summary to Splunk's HEC as a single event.
+func (n *splunkNotifier) Notify(logName string, summary Summary) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"event": map[string]interface{}{
+			"log":     logName,
+			"summary": summary,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Splunk "+n.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("splunk: unexpected status %s", resp.Status)
+	}
+
+	return nil
+}
+
+// An exec notifier: spawns a command and writes the matches to its stdin.
+type execNotifier struct {
+	command string
+	args    []string
+}
+
+// Create a new exec notifier.
+func NewExecNotifier(command string, args []string) *execNotifier {
+	return &execNotifier{command: command, args: args}
+}
+
+// Run the command with the matches on stdin.
+func (n *execNotifier) Notify(logName string, summary Summary) error {
+	cmd := exec.Command(n.command, n.args...)
+	cmd.Stdin = strings.NewReader(joinLines(summary.Samples))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	return cmd.Run()
+}
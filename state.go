@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Default directory for persisted state when a config doesn't set one.
+const defaultStateDir = "/var/lib/zaqar"
+
+// How often startPipeline persists its offset: after this many lines, or
+// this long, whichever comes first.
+const (
+	stateFlushLines    = 100
+	stateFlushInterval = 5 * time.Second
+)
+
+const stateFileName = "state.json"
+
+// Persisted offset/identity state for one log.
+type logState struct {
+	Offset int64  `json:"offset"`
+	Dev    uint64 `json:"dev"`
+	Ino    uint64 `json:"ino"`
+}
+
+// A StateStore persists per-log byte offsets (with each file's device/inode)
+// to a JSON file under a configurable directory, so a restarted daemon can
+// resume a follow-mode log instead of replaying or dropping its tail.
+type StateStore struct {
+	dir   string
+	mu    sync.Mutex
+	state map[string]logState
+}
+
+// Create or load a StateStore rooted at dir.
+func NewStateStore(dir string) (*StateStore, error) {
+	s := &StateStore{dir: dir, state: make(map[string]logState)}
+
+	data, err := ioutil.ReadFile(s.path())
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &s.state); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// The path to the state file.
+func (s *StateStore) path() string {
+	return filepath.Join(s.dir, stateFileName)
+}
+
+// Look up the stored state for a log, if any.
+func (s *StateStore) Get(name string) (logState, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, ok := s.state[name]
+	return st, ok
+}
+
+// Record the current offset/identity for a log.
+func (s *StateStore) Set(name string, st logState) error {
+	s.mu.Lock()
+	s.state[name] = st
+	s.mu.Unlock()
+
+	return s.flush()
+}
+
+// Remove the stored state for a log, so its next run starts from offset 0.
+func (s *StateStore) Reset(name string) error {
+	s.mu.Lock()
+	delete(s.state, name)
+	s.mu.Unlock()
+
+	return s.flush()
+}
+
+// Return a snapshot of every log's stored state, for --print-state.
+func (s *StateStore) All() map[string]logState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	all := make(map[string]logState, len(s.state))
+	for name, st := range s.state {
+		all[name] = st
+	}
+
+	return all
+}
+
+// Atomically rewrite the state file. Every log's pipeline flushes on its
+// own timer/line-count cadence, so the whole marshal-write-rename sequence
+// has to stay one critical section: releasing the lock after marshaling
+// would let two flushes interleave writes to the same tmp path.
+func (s *StateStore) flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := json.MarshalIndent(s.state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+
+	tmp := s.path() + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, s.path())
+}
+
+// Extract the device/inode identity of a file, the same identity
+// StateStore uses to tell a resumed log apart from a rotated one.
+func fileIdentity(info os.FileInfo) (dev, ino uint64) {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Dev), st.Ino
+	}
+
+	return 0, 0
+}
+
+// Print every log's persisted state to stdout, for --print-state.
+func printState(store *StateStore) {
+	for name, st := range store.All() {
+		fmt.Printf("%s\toffset=%d\tdev=%d\tino=%d\n", name, st.Offset, st.Dev, st.Ino)
+	}
+}
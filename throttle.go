@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Summary describes one batch of matches handed to a notifier: how many
+// there were, the window they spanned, and the matches themselves.
+type Summary struct {
+	GroupKey string
+	Count    int
+	First    time.Time
+	Last     time.Time
+	Samples  []Match
+}
+
+// Per-group accumulation state for one log's alert window.
+type window struct {
+	matches     []Match
+	windowStart time.Time
+	cooldownAt  time.Time // zero until a notification has fired once
+}
+
+// A throttler gates notifications behind a per-log window/threshold/
+// cooldown, grouped by an optional set of event fields. It exists because
+// a long-running, follow-mode pipeline can't wait until EOF to alert.
+type throttler struct {
+	mu      sync.Mutex
+	windows map[string]*window // keyed by "<logName>\x00<groupKey>"
+}
+
+// Create a new throttler.
+func NewThrottler() *throttler {
+	return &throttler{windows: make(map[string]*window)}
+}
+
+// Record a match for a log/event and report whether its group has now
+// reached threshold and cleared its cooldown, along with the summary to
+// notify with if so. captures holds the matching regexp's capture groups,
+// if any, for group_by entries that reference them by index.
+func (t *throttler) Record(name string, logc logConfig, event Event, captures []string) (Summary, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	groupKey := groupKeyFor(logc.GroupBy, event, captures)
+	w := t.windowFor(name, groupKey, now, time.Duration(logc.Window))
+	w.matches = append(w.matches, Match{Line: lineOf(event)})
+
+	threshold := logc.Threshold
+	if threshold <= 0 {
+		threshold = 1
+	}
+	if len(w.matches) < threshold {
+		return Summary{}, false
+	}
+	if !w.cooldownAt.IsZero() && now.Before(w.cooldownAt) {
+		return Summary{}, false
+	}
+
+	summary := Summary{GroupKey: groupKey, Count: len(w.matches), First: w.windowStart, Last: now, Samples: w.matches}
+
+	w.matches = nil
+	w.windowStart = now
+	if cooldown := time.Duration(logc.Cooldown); cooldown > 0 {
+		w.cooldownAt = now.Add(cooldown)
+	}
+
+	return summary, true
+}
+
+// Force-summarize any matches still pending below threshold for a log,
+// clearing them. Used at EOF for one-shot (non-follow) runs, which don't
+// get a later chance to reach threshold.
+func (t *throttler) Flush(name string) []Summary {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	prefix := name + "\x00"
+	var summaries []Summary
+	for key, w := range t.windows {
+		if !strings.HasPrefix(key, prefix) || len(w.matches) == 0 {
+			continue
+		}
+
+		summaries = append(summaries, Summary{
+			GroupKey: strings.TrimPrefix(key, prefix),
+			Count:    len(w.matches),
+			First:    w.windowStart,
+			Last:     time.Now(),
+			Samples:  w.matches,
+		})
+		w.matches = nil
+	}
+
+	return summaries
+}
+
+// Return the cooldown-until time of every group of a log that currently
+// has one active, keyed by group key.
+func (t *throttler) Cooldowns(name string) map[string]time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	prefix := name + "\x00"
+	cooldowns := make(map[string]time.Time)
+	for key, w := range t.windows {
+		if strings.HasPrefix(key, prefix) && !w.cooldownAt.IsZero() {
+			cooldowns[strings.TrimPrefix(key, prefix)] = w.cooldownAt
+		}
+	}
+
+	return cooldowns
+}
+
+// Find or start the window for a (log, group) key, rolling it over if its
+// size has been configured and exceeded. A rollover only resets the
+// match-accumulation fields: cooldownAt is alert state, not window state,
+// and must survive a window boundary or a short window would forget an
+// in-progress cooldown as soon as it elapsed.
+func (t *throttler) windowFor(name, groupKey string, now time.Time, size time.Duration) *window {
+	key := name + "\x00" + groupKey
+
+	w, ok := t.windows[key]
+	if !ok {
+		w = &window{windowStart: now}
+		t.windows[key] = w
+		return w
+	}
+
+	if size > 0 && now.Sub(w.windowStart) > size {
+		w.matches = nil
+		w.windowStart = now
+	}
+
+	return w
+}
+
+// Compute the group key for an event: the values of the configured
+// group_by entries joined with "/", or "" if none are configured. Each
+// entry is either an event field name, or a regexp capture group index
+// (0 being the whole match) resolved against captures.
+func groupKeyFor(groupBy []string, event Event, captures []string) string {
+	if len(groupBy) == 0 {
+		return ""
+	}
+
+	parts := make([]string, len(groupBy))
+	for i, field := range groupBy {
+		if idx, err := strconv.Atoi(field); err == nil {
+			if idx >= 0 && idx < len(captures) {
+				parts[i] = captures[idx]
+			}
+			continue
+		}
+
+		if v, ok := event[field]; ok {
+			parts[i] = fmt.Sprint(v)
+		}
+	}
+
+	return strings.Join(parts, "/")
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestThrottlerThreshold(t *testing.T) {
+	th := NewThrottler()
+	logc := logConfig{Threshold: 3}
+
+	for i := 0; i < 2; i++ {
+		if _, ready := th.Record("access", logc, Event{lineField: "x"}, nil); ready {
+			t.Fatalf("Record() became ready before threshold, on match %d", i+1)
+		}
+	}
+
+	summary, ready := th.Record("access", logc, Event{lineField: "x"}, nil)
+	if !ready {
+		t.Fatal("Record() did not become ready at threshold")
+	}
+	if summary.Count != 3 {
+		t.Errorf("summary.Count = %d, want 3", summary.Count)
+	}
+}
+
+func TestThrottlerCooldown(t *testing.T) {
+	th := NewThrottler()
+	logc := logConfig{Threshold: 1, Cooldown: duration(time.Hour)}
+
+	if _, ready := th.Record("access", logc, Event{lineField: "x"}, nil); !ready {
+		t.Fatal("Record() did not fire on first match")
+	}
+	if _, ready := th.Record("access", logc, Event{lineField: "x"}, nil); ready {
+		t.Fatal("Record() fired again during cooldown")
+	}
+
+	if cooldowns := th.Cooldowns("access"); len(cooldowns) != 1 {
+		t.Errorf("Cooldowns() returned %d entries, want 1", len(cooldowns))
+	}
+}
+
+func TestThrottlerCooldownSurvivesWindowRollover(t *testing.T) {
+	th := NewThrottler()
+	logc := logConfig{Threshold: 1, Window: duration(10 * time.Millisecond), Cooldown: duration(time.Hour)}
+
+	if _, ready := th.Record("access", logc, Event{lineField: "x"}, nil); !ready {
+		t.Fatal("Record() did not fire on first match")
+	}
+
+	time.Sleep(20 * time.Millisecond) // let the window elapse, not the cooldown
+
+	if _, ready := th.Record("access", logc, Event{lineField: "x"}, nil); ready {
+		t.Fatal("Record() fired again after only the window rolled over, cooldown should still be active")
+	}
+}
+
+func TestThrottlerGroupByField(t *testing.T) {
+	th := NewThrottler()
+	logc := logConfig{Threshold: 1, GroupBy: []string{"host"}}
+
+	summary, ready := th.Record("access", logc, Event{lineField: "x", "host": "a"}, nil)
+	if !ready || summary.GroupKey != "a" {
+		t.Fatalf("Record() = %+v, %v; want GroupKey %q, ready", summary, ready, "a")
+	}
+
+	// A different group key starts its own window rather than sharing
+	// the first group's threshold.
+	if _, ready := th.Record("access", logc, Event{lineField: "x", "host": "b"}, nil); !ready {
+		t.Fatal("Record() for a distinct group did not fire independently")
+	}
+}
+
+func TestThrottlerGroupByCaptureIndex(t *testing.T) {
+	th := NewThrottler()
+	logc := logConfig{Threshold: 1, GroupBy: []string{"1"}}
+
+	captures := []string{"disk panic on sda1", "sda1"}
+	summary, ready := th.Record("access", logc, Event{lineField: captures[0]}, captures)
+	if !ready || summary.GroupKey != "sda1" {
+		t.Fatalf("Record() = %+v, %v; want GroupKey %q, ready", summary, ready, "sda1")
+	}
+}
+
+func TestThrottlerFlush(t *testing.T) {
+	th := NewThrottler()
+	logc := logConfig{Threshold: 10}
+
+	th.Record("access", logc, Event{lineField: "x"}, nil)
+
+	summaries := th.Flush("access")
+	if len(summaries) != 1 || summaries[0].Count != 1 {
+		t.Fatalf("Flush() = %+v, want one summary with Count 1", summaries)
+	}
+
+	// A second flush has nothing left pending.
+	if summaries := th.Flush("access"); len(summaries) != 0 {
+		t.Errorf("Flush() after a flush returned %+v, want none", summaries)
+	}
+}